@@ -0,0 +1,91 @@
+package connectinject
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// annotationStatus is the key of the annotation that is added to
+	// a pod after an injection is done.
+	annotationStatus = "consul.hashicorp.com/connect-inject-status"
+
+	// annotationInject is the key of the annotation that controls whether
+	// injection is explicitly enabled or disabled for a pod. This should
+	// be set to a truthy or falsy value parseable by strconv.ParseBool.
+	// Absence of the annotation is decided by Handler.RequireAnnotation:
+	// when it is false pods are injected unless explicitly disabled, when
+	// it is true only pods that explicitly enable injection are injected.
+	annotationInject = "consul.hashicorp.com/connect-inject"
+
+	// annotationService is the name of the service to register with
+	// Consul. If unset, it defaults to the name of the first container
+	// in the pod.
+	annotationService = "consul.hashicorp.com/connect-service"
+
+	// annotationPort is the name or number of the port to register as
+	// the service port for the service registered with Consul. If this
+	// names a port, it must match the name of a port on the first
+	// container in the pod.
+	annotationPort = "consul.hashicorp.com/connect-service-port"
+
+	// annotationUpstreams is a comma-separated list of upstream services
+	// this pod needs to talk to via Connect, as "name:port" pairs. Port
+	// may either be numeric or name a port on one of the pod's own
+	// containers.
+	annotationUpstreams = "consul.hashicorp.com/connect-service-upstreams"
+
+	// injected is the value of annotationStatus once injection has run
+	// for a pod.
+	injected = "injected"
+)
+
+// shouldInject returns whether pod should have Connect injected into it,
+// consulting the per-pod opt-in/opt-out annotation. Absence of the
+// annotation, or a value that doesn't parse as a bool, falls back to the
+// policy requireAnnotation selects: false injects unless the pod
+// explicitly opts out, true injects only pods that explicitly opt in.
+func shouldInject(pod *corev1.Pod, requireAnnotation bool) bool {
+	raw, ok := pod.Annotations[annotationInject]
+	if !ok {
+		return !requireAnnotation
+	}
+
+	inject, err := strconv.ParseBool(raw)
+	if err != nil {
+		return !requireAnnotation
+	}
+
+	return inject
+}
+
+// defaultAnnotations fills in any connect-inject annotations that the
+// user didn't set explicitly, deriving them from the pod spec so that
+// callers (containerSidecar, containerInit, ...) always have a service
+// name and, where unambiguous, a service port to work with.
+func (h *Handler) defaultAnnotations(pod *corev1.Pod) error {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+
+	if _, ok := pod.Annotations[annotationService]; !ok {
+		if len(pod.Spec.Containers) == 0 {
+			return nil
+		}
+
+		pod.Annotations[annotationService] = pod.Spec.Containers[0].Name
+	}
+
+	if _, ok := pod.Annotations[annotationPort]; !ok {
+		if cs := pod.Spec.Containers; len(cs) > 0 && len(cs[0].Ports) == 1 {
+			if p := cs[0].Ports[0]; p.Name != "" {
+				pod.Annotations[annotationPort] = p.Name
+			} else {
+				pod.Annotations[annotationPort] = strconv.Itoa(int(p.ContainerPort))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package connectinject
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CertProvider issues short-lived Connect leaf certificates for injected
+// pods and supplies the sidecar that keeps them renewed. It's an
+// interface rather than a concrete Consul CA client so an operator can
+// plug in Vault or another PKI instead without changing Handler.
+type CertProvider interface {
+	// IssueForPod issues a leaf certificate for pod, returning the
+	// PEM-encoded cert, its private key, the CA bundle needed to
+	// validate it, and the ttl the provider actually issued it for.
+	IssueForPod(pod *corev1.Pod) (certPEM, keyPEM, caPEM []byte, ttl time.Duration, err error)
+
+	// RenewerContainer returns the sidecar container that refreshes the
+	// certificate mounted at certVolumeMount before it expires. Handler
+	// adds the volume mount and the CONNECT_SERVICE_NAME/CONNECT_CERT_TTL
+	// env vars itself.
+	RenewerContainer() corev1.Container
+}
+
+// ConsulCAProvider is the Consul-backed CertProvider: it issues leaf
+// certificates from the Consul Connect CA via the local Consul agent.
+type ConsulCAProvider struct {
+	// Client talks to the local Consul agent that IssueForPod issues
+	// certificates from and RenewerContainer's sidecar renews against.
+	Client *api.Client
+
+	// ImageConsul is the Docker image used for RenewerContainer.
+	ImageConsul string
+}
+
+// IssueForPod issues a Connect leaf certificate for the service named by
+// pod's annotationService annotation.
+func (p *ConsulCAProvider) IssueForPod(pod *corev1.Pod) (certPEM, keyPEM, caPEM []byte, ttl time.Duration, err error) {
+	service := pod.Annotations[annotationService]
+	if service == "" {
+		return nil, nil, nil, 0, fmt.Errorf("pod is missing the %s annotation", annotationService)
+	}
+
+	leaf, _, err := p.Client.Agent().ConnectCALeaf(service, nil)
+	if err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("error issuing leaf cert for %q: %s", service, err)
+	}
+
+	roots, _, err := p.Client.Agent().ConnectCARoots(nil)
+	if err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("error fetching CA roots: %s", err)
+	}
+
+	for _, root := range roots.Roots {
+		if root.Active {
+			caPEM = []byte(root.RootCertPEM)
+			break
+		}
+	}
+
+	return []byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM), caPEM, time.Until(leaf.ValidBefore), nil
+}
+
+// RenewerContainer returns the sidecar that periodically re-fetches the
+// leaf certificate from the local Consul agent and rewrites it into the
+// shared cert volume. Leaf cert issuance/renewal has no CLI verb of its
+// own - it's an Agent HTTP API call, the same one IssueForPod makes via
+// the Go client - so the renewer polls that endpoint directly with curl,
+// using its blocking-query support to avoid needless re-fetches between
+// actual rotations.
+func (p *ConsulCAProvider) RenewerContainer() corev1.Container {
+	return corev1.Container{
+		Name:    "consul-connect-cert-renewer",
+		Image:   p.ImageConsul,
+		Command: []string{"/bin/sh", "-ec", consulCARenewerCommand},
+	}
+}
+
+// consulCARenewerCommand long-polls the local agent's
+// /v1/agent/connect/ca/leaf/<service> endpoint, which blocks until a new
+// leaf certificate is issued, and rewrites the cert/key files whenever it
+// returns one. $CONNECT_SERVICE_NAME is set by certContainers.
+const consulCARenewerCommand = `
+set -e
+index=0
+while true; do
+  resp=$(curl -s -f "http://127.0.0.1:8500/v1/agent/connect/ca/leaf/${CONNECT_SERVICE_NAME}?index=${index}&wait=10m")
+  if [ -z "$resp" ]; then
+    sleep 5
+    continue
+  fi
+
+  echo "$resp" | sed -n 's/.*"CertPEM":"\([^"]*\)".*/\1/p' | sed 's/\\n/\n/g' >/consul/connect-inject/certs/cert.pem
+  echo "$resp" | sed -n 's/.*"PrivateKeyPEM":"\([^"]*\)".*/\1/p' | sed 's/\\n/\n/g' >/consul/connect-inject/certs/key.pem
+  index=$(echo "$resp" | sed -n 's/.*"ModifyIndex":\([0-9]*\).*/\1/p')
+
+  sleep 1
+done
+`
@@ -0,0 +1,84 @@
+package connectinject
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// certVolumeName is the shared volume the leaf cert, its key, and the CA
+// bundle are written into for the sidecar and the renewer container to
+// read from.
+const certVolumeName = "consul-connect-inject-certs"
+
+func certVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: certVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium: corev1.StorageMediumMemory,
+			},
+		},
+	}
+}
+
+func certVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      certVolumeName,
+		MountPath: "/consul/connect-inject/certs",
+	}
+}
+
+// sidecarTLSFlags returns the consul connect proxy flags that point it at
+// the leaf cert, key, and CA bundle certContainers writes to (and keeps
+// current in) the shared cert volume, added to the sidecar's command
+// whenever Handler.CertProvider is set.
+func sidecarTLSFlags() []string {
+	return []string{
+		"-tls-cert-file=/consul/connect-inject/certs/cert.pem",
+		"-tls-key-file=/consul/connect-inject/certs/key.pem",
+		"-tls-ca-file=/consul/connect-inject/certs/ca.pem",
+	}
+}
+
+// certInitCommandTpl writes the cert, key, and CA bundle issued by
+// Handler.CertProvider into the shared cert volume before the sidecar
+// starts.
+const certInitCommandTpl = `
+set -ex
+cat <<EOF >/consul/connect-inject/certs/cert.pem
+%s
+EOF
+cat <<EOF >/consul/connect-inject/certs/key.pem
+%s
+EOF
+cat <<EOF >/consul/connect-inject/certs/ca.pem
+%s
+EOF
+`
+
+// certContainers issues a leaf certificate for pod via h.CertProvider and
+// returns the init container that writes it to the shared cert volume
+// alongside the renewer container that keeps it fresh.
+func (h *Handler) certContainers(pod *corev1.Pod) (init, renewer corev1.Container, err error) {
+	certPEM, keyPEM, caPEM, ttl, err := h.CertProvider.IssueForPod(pod)
+	if err != nil {
+		return corev1.Container{}, corev1.Container{}, fmt.Errorf("error issuing leaf certificate: %s", err)
+	}
+
+	init = corev1.Container{
+		Name:         "consul-connect-cert-init",
+		Image:        h.ImageConsul,
+		Command:      []string{"/bin/sh", "-ec", fmt.Sprintf(certInitCommandTpl, certPEM, keyPEM, caPEM)},
+		VolumeMounts: []corev1.VolumeMount{certVolumeMount()},
+	}
+
+	renewer = h.CertProvider.RenewerContainer()
+	renewer.VolumeMounts = append(renewer.VolumeMounts, certVolumeMount())
+	renewer.Env = append(renewer.Env,
+		corev1.EnvVar{Name: "CONNECT_SERVICE_NAME", Value: pod.Annotations[annotationService]},
+		corev1.EnvVar{Name: "CONNECT_CERT_TTL", Value: ttl.String()},
+	)
+
+	return init, renewer, nil
+}
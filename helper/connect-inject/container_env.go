@@ -0,0 +1,83 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// upstream is a single parsed entry from annotationUpstreams.
+type upstream struct {
+	Name string
+	Port string
+}
+
+// parseUpstreams parses the comma-separated "name:port" list in
+// annotationUpstreams. Port may be numeric or may name a port on one of
+// the pod's own containers, resolved later by resolveUpstreamPort.
+func parseUpstreams(raw string) ([]upstream, error) {
+	var upstreams []upstream
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("upstream %q is not in the form name:port", entry)
+		}
+
+		upstreams = append(upstreams, upstream{Name: parts[0], Port: parts[1]})
+	}
+
+	return upstreams, nil
+}
+
+// resolveUpstreamPort returns port unchanged if it's already numeric,
+// otherwise it looks up a container port of that name on pod. The same
+// lookup resolves annotationPort in containerSidecar and containerInit.
+func resolveUpstreamPort(pod *corev1.Pod, port string) string {
+	if _, err := strconv.Atoi(port); err == nil {
+		return port
+	}
+
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == port {
+				return strconv.Itoa(int(p.ContainerPort))
+			}
+		}
+	}
+
+	return port
+}
+
+// containerEnvVars returns, for each upstream declared in
+// annotationUpstreams, the <NAME>_CONNECT_SERVICE_HOST and
+// <NAME>_CONNECT_SERVICE_PORT environment variables that should be added
+// to every application container, mirroring the _SERVICE_HOST/_SERVICE_PORT
+// variables Kubernetes injects for Services. Hyphens in the upstream name
+// are normalized to underscores since they aren't valid in env var names.
+func (h *Handler) containerEnvVars(pod *corev1.Pod) ([]corev1.EnvVar, error) {
+	raw := pod.Annotations[annotationUpstreams]
+	if raw == "" {
+		return nil, nil
+	}
+
+	upstreams, err := parseUpstreams(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var envVars []corev1.EnvVar
+	for _, u := range upstreams {
+		port := resolveUpstreamPort(pod, u.Port)
+		name := strings.ToUpper(strings.Replace(u.Name, "-", "_", -1))
+
+		envVars = append(envVars,
+			corev1.EnvVar{Name: name + "_CONNECT_SERVICE_HOST", Value: "127.0.0.1"},
+			corev1.EnvVar{Name: name + "_CONNECT_SERVICE_PORT", Value: port},
+		)
+	}
+
+	return envVars, nil
+}
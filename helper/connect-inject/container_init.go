@@ -0,0 +1,108 @@
+package connectinject
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// initContainerCommandTpl renders the shell script run by the init
+// container: it writes a Consul service definition for the pod into the
+// shared data volume and registers it with the local Consul agent before
+// the application containers start. It registers under $POD_NAME, read at
+// container runtime rather than baked in at patch-build time, since a pod
+// created by a Deployment/ReplicaSet/StatefulSet doesn't have its name
+// assigned yet when the admission webhook runs.
+const initContainerCommandTpl = `
+set -ex
+
+cat <<EOF >/consul/connect-inject/service.hcl
+service {
+  name = "{{ .ServiceName }}"
+  {{- if .ServicePort }}
+  port = {{ .ServicePort }}
+  {{- end }}
+  connect {
+    sidecar_service {
+      proxy {
+        {{- range .Upstreams }}
+        upstreams {
+          destination_name = "{{ .Name }}"
+          local_bind_port = {{ .Port }}
+        }
+        {{- end }}
+      }
+    }
+  }
+}
+EOF
+
+consul services register -id "${POD_NAME}" /consul/connect-inject/service.hcl
+`
+
+// initContainerCommandData is the set of fields available to
+// initContainerCommandTpl.
+type initContainerCommandData struct {
+	ServiceName string
+	ServicePort string
+	Upstreams   []initContainerUpstream
+}
+
+// initContainerUpstream is a single resolved upstream entry available to
+// initContainerCommandTpl.
+type initContainerUpstream struct {
+	Name string
+	Port string
+}
+
+// containerInit returns the init container that bootstraps Connect for
+// the pod: it renders the pod's service definition from its connect-inject
+// annotations and registers it with the local Consul agent prior to the
+// application containers starting.
+func (h *Handler) containerInit(pod *corev1.Pod) (corev1.Container, error) {
+	data := initContainerCommandData{
+		ServiceName: pod.Annotations[annotationService],
+	}
+
+	if port := pod.Annotations[annotationPort]; port != "" {
+		data.ServicePort = resolveUpstreamPort(pod, port)
+	}
+
+	if raw := pod.Annotations[annotationUpstreams]; raw != "" {
+		upstreams, err := parseUpstreams(raw)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+
+		for _, u := range upstreams {
+			data.Upstreams = append(data.Upstreams, initContainerUpstream{
+				Name: u.Name,
+				Port: resolveUpstreamPort(pod, u.Port),
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(initContainerCommandTpl)))
+	if err := tpl.Execute(&buf, data); err != nil {
+		return corev1.Container{}, fmt.Errorf("error rendering init container command: %s", err)
+	}
+
+	return corev1.Container{
+		Name:  "consul-connect-inject-init",
+		Image: h.ImageConsul,
+		Env: []corev1.EnvVar{
+			{
+				Name: "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				},
+			},
+		},
+		Command:      []string{"/bin/sh", "-ec", buf.String()},
+		VolumeMounts: []corev1.VolumeMount{h.volumeMount()},
+	}, nil
+}
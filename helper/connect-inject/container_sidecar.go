@@ -0,0 +1,41 @@
+package connectinject
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerSidecar returns the Envoy/Connect proxy sidecar container that
+// is injected alongside the application containers. It reads its
+// configuration entirely from pod's connect-inject annotations, which by
+// the time this is called have already been defaulted by
+// defaultAnnotations.
+func (h *Handler) containerSidecar(pod *corev1.Pod) corev1.Container {
+	command := []string{
+		"consul", "connect", "proxy",
+		fmt.Sprintf("-service=%s", pod.Annotations[annotationService]),
+	}
+
+	if port := pod.Annotations[annotationPort]; port != "" {
+		command = append(command, fmt.Sprintf("-service-addr=127.0.0.1:%s", resolveUpstreamPort(pod, port)))
+	}
+
+	if raw := pod.Annotations[annotationUpstreams]; raw != "" {
+		// Malformed entries are caught by containerInit's own parsing,
+		// which runs as part of the same Mutate call and fails the whole
+		// admission response; here we can just skip them.
+		if upstreams, err := parseUpstreams(raw); err == nil {
+			for _, u := range upstreams {
+				command = append(command, fmt.Sprintf("-upstream=%s:%s", u.Name, resolveUpstreamPort(pod, u.Port)))
+			}
+		}
+	}
+
+	return corev1.Container{
+		Name:         "consul-connect-envoy-sidecar",
+		Image:        h.ImageEnvoy,
+		Command:      command,
+		VolumeMounts: []corev1.VolumeMount{h.volumeMount()},
+	}
+}
@@ -0,0 +1,30 @@
+package connectinject
+
+import corev1 "k8s.io/api/core/v1"
+
+// volumeName is the name of the in-memory emptyDir volume shared between
+// the init container and the sidecar, used to hand off the rendered
+// Consul service definition and Connect bootstrap files.
+const volumeName = "consul-connect-inject-data"
+
+// volumeData returns the shared volume added to a pod's spec the first
+// time it is injected.
+func (h *Handler) volumeData() corev1.Volume {
+	return corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium: corev1.StorageMediumMemory,
+			},
+		},
+	}
+}
+
+// volumeMount returns the mount of volumeData shared by the init
+// container and the sidecar.
+func (h *Handler) volumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: "/consul/connect-inject",
+	}
+}
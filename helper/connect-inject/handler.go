@@ -0,0 +1,284 @@
+// Package connectinject implements a Kubernetes mutating admission webhook
+// that injects a Consul Connect sidecar (and its supporting init
+// container) into pods opting into Connect.
+package connectinject
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mattbaird/jsonpatch"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PatchType selects how Handler.Mutate represents the changes it makes
+// to a pod in the returned AdmissionResponse.
+type PatchType string
+
+const (
+	// JSONPatch emits a JSON Patch (RFC 6902) built from individual add
+	// operations (replace for an annotation the pod already has). This is
+	// the default.
+	JSONPatch PatchType = "JSONPatch"
+
+	// StrategicMergePatch computes the mutation as a strategic merge
+	// patch against the corev1.Pod schema rather than the hand-rolled
+	// ops jsonPatchResponse builds - unlike JSONPatch it preserves
+	// field-removal semantics and merges list fields by key instead of
+	// by index - then translates the result into the RFC 6902 JSON
+	// Patch ops array that's actually returned, since "JSONPatch" is the
+	// only PatchType a real apiserver accepts.
+	StrategicMergePatch PatchType = "StrategicMergePatch"
+)
+
+// Handler is the HTTP handler for the mutating admission webhook that
+// injects the Connect sidecar into pods.
+type Handler struct {
+	// ImageConsul is the Docker image for the Consul init container
+	// that bootstraps and registers Connect for the pod.
+	ImageConsul string
+
+	// ImageEnvoy is the Docker image for the Connect proxy sidecar.
+	ImageEnvoy string
+
+	// PatchType selects how the mutation is represented in the
+	// AdmissionResponse. The zero value behaves like JSONPatch.
+	PatchType PatchType
+
+	// AllowedNamespaces, if non-empty, restricts injection to pods in
+	// one of these namespaces; any other namespace is treated the same
+	// as the hardcoded kube-system exclusion.
+	AllowedNamespaces []string
+
+	// DeniedNamespaces excludes pods in these namespaces from injection
+	// regardless of AllowedNamespaces or any per-pod annotation.
+	DeniedNamespaces []string
+
+	// NamespaceSelector, if set, further restricts injection to pods
+	// whose labels it matches. The AdmissionRequest doesn't carry the
+	// namespace object's own labels, so this is evaluated against the
+	// pod's labels rather than its namespace's.
+	NamespaceSelector labels.Selector
+
+	// RequireAnnotation selects the opt-in/opt-out policy used when a
+	// pod doesn't set annotationInject: false (the zero value) injects
+	// every eligible pod unless it explicitly opts out, preserving the
+	// original inject-by-default behavior for any Handler that doesn't
+	// set this field; true injects only pods that explicitly opt in.
+	RequireAnnotation bool
+
+	// CertProvider issues the per-pod leaf certificate used to secure
+	// the sidecar's Connect TLS, and its renewer sidecar. TLS bootstrap
+	// is skipped entirely when CertProvider is nil.
+	CertProvider CertProvider
+}
+
+// namespaceIsExcluded reports whether pod's namespace/label configuration
+// excludes it from injection, checked ahead of the per-pod annotationInject
+// opt-in/opt-out policy.
+func (h *Handler) namespaceIsExcluded(pod *corev1.Pod) bool {
+	if pod.Namespace == metav1.NamespaceSystem {
+		return true
+	}
+
+	for _, ns := range h.DeniedNamespaces {
+		if ns == pod.Namespace {
+			return true
+		}
+	}
+
+	if len(h.AllowedNamespaces) > 0 {
+		allowed := false
+		for _, ns := range h.AllowedNamespaces {
+			if ns == pod.Namespace {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+
+	if h.NamespaceSelector != nil && !h.NamespaceSelector.Matches(labels.Set(pod.Labels)) {
+		return true
+	}
+
+	return false
+}
+
+// Handle is the http.HandlerFunc implementation that serves the admission
+// webhook endpoint: it decodes the AdmissionReview request, runs Mutate,
+// and writes back the resulting AdmissionReview response.
+func (h *Handler) Handle(rw http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		http.Error(rw, fmt.Sprintf("invalid content-type: %q", ct), http.StatusBadRequest)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("error reading request body: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(body) == 0 {
+		http.Error(rw, "request body is empty", http.StatusBadRequest)
+		return
+	}
+
+	var admReq v1beta1.AdmissionReview
+	var admResp v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &admReq); err != nil {
+		admResp.Response = &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{Message: fmt.Sprintf("error decoding admission request: %s", err)},
+		}
+	} else {
+		admResp.Response = h.Mutate(admReq.Request)
+	}
+
+	resp, err := json.Marshal(&admResp)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error marshalling admission response: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(resp)
+}
+
+// Mutate takes an admission request and returns an admission response
+// patching the pod it contains with a Connect sidecar and the init
+// container that bootstraps it, unless the pod's namespace is excluded
+// by AllowedNamespaces/DeniedNamespaces/NamespaceSelector, the pod has
+// already been injected, or its annotationInject value doesn't satisfy
+// RequireAnnotation's opt-in/opt-out policy.
+func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return errorResponse("could not unmarshal pod: %s", err)
+	}
+
+	if h.namespaceIsExcluded(&pod) {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+	if pod.Annotations[annotationStatus] == injected {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+	if !shouldInject(&pod, h.RequireAnnotation) {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	original := pod.DeepCopy()
+
+	if err := h.defaultAnnotations(&pod); err != nil {
+		return errorResponse("error creating default annotations: %s", err)
+	}
+
+	sidecar := h.containerSidecar(&pod)
+	initContainer, err := h.containerInit(&pod)
+	if err != nil {
+		return errorResponse("error generating init container: %s", err)
+	}
+
+	envVars, err := h.containerEnvVars(&pod)
+	if err != nil {
+		return errorResponse("error generating upstream env vars: %s", err)
+	}
+
+	containers := []corev1.Container{sidecar}
+	initContainers := []corev1.Container{initContainer}
+	volumes := []corev1.Volume{h.volumeData()}
+
+	if h.CertProvider != nil {
+		certInit, renewer, err := h.certContainers(&pod)
+		if err != nil {
+			return errorResponse("error bootstrapping TLS: %s", err)
+		}
+
+		containers[0].VolumeMounts = append(containers[0].VolumeMounts, certVolumeMount())
+		containers[0].Command = append(containers[0].Command, sidecarTLSFlags()...)
+		containers = append(containers, renewer)
+		initContainers = append(initContainers, certInit)
+		volumes = append(volumes, certVolume())
+	}
+
+	if h.PatchType == StrategicMergePatch {
+		return h.strategicMergeResponse(original, &pod, containers, initContainers, volumes, envVars)
+	}
+
+	return h.jsonPatchResponse(&pod, containers, initContainers, volumes, envVars)
+}
+
+// jsonPatchResponse builds the default JSON Patch (RFC 6902) representing
+// the injection of containers, initContainers, volumes, and envVars into
+// pod.
+func (h *Handler) jsonPatchResponse(pod *corev1.Pod, containers, initContainers []corev1.Container, volumes []corev1.Volume, envVars []corev1.EnvVar) *v1beta1.AdmissionResponse {
+	var patches []jsonpatch.JsonPatchOperation
+	patches = append(patches, addContainer(pod.Spec.Containers, containers, "/spec/containers")...)
+	patches = append(patches, addContainer(pod.Spec.InitContainers, initContainers, "/spec/initContainers")...)
+	patches = append(patches, addVolume(pod.Spec.Volumes, volumes, "/spec/volumes")...)
+	for i, c := range pod.Spec.Containers {
+		patches = append(patches, addEnvVar(c.Env, envVars, fmt.Sprintf("/spec/containers/%d/env", i))...)
+	}
+	patches = append(patches, updateAnnotation(pod.Annotations, map[string]string{annotationStatus: injected})...)
+
+	patchesJSON, err := json.Marshal(patches)
+	if err != nil {
+		return errorResponse("error marshalling patch: %s", err)
+	}
+
+	patchType := v1beta1.PatchTypeJSONPatch
+	return &v1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchesJSON,
+		PatchType: &patchType,
+	}
+}
+
+// strategicMergeResponse builds the same injection as jsonPatchResponse,
+// by diffing original against a full copy of pod with containers,
+// initContainers, volumes, and envVars applied, but computes the diff via
+// strategic merge semantics instead of jsonPatchResponse's hand-rolled
+// ops before translating it into the JSON Patch ops actually returned.
+// Since original is taken before defaultAnnotations runs, the patch also
+// adds the annotations defaultAnnotations filled in, which
+// jsonPatchResponse does not.
+func (h *Handler) strategicMergeResponse(original, pod *corev1.Pod, containers, initContainers []corev1.Container, volumes []corev1.Volume, envVars []corev1.EnvVar) *v1beta1.AdmissionResponse {
+	updated := pod.DeepCopy()
+	for i := range updated.Spec.Containers {
+		updated.Spec.Containers[i].Env = append(updated.Spec.Containers[i].Env, envVars...)
+	}
+	updated.Spec.Containers = append(updated.Spec.Containers, containers...)
+	updated.Spec.InitContainers = append(updated.Spec.InitContainers, initContainers...)
+	updated.Spec.Volumes = append(updated.Spec.Volumes, volumes...)
+	updated.Annotations[annotationStatus] = injected
+
+	patch, err := strategicJSONPatch(original, updated)
+	if err != nil {
+		return errorResponse("error creating strategic merge patch: %s", err)
+	}
+
+	patchType := v1beta1.PatchTypeJSONPatch
+	return &v1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+// errorResponse returns an AdmissionResponse that disallows the request
+// and surfaces format/args as the rejection message.
+func errorResponse(format string, args ...interface{}) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{Message: fmt.Sprintf(format, args...)},
+	}
+}
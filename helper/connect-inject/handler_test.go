@@ -4,14 +4,17 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mattbaird/jsonpatch"
 	"github.com/stretchr/testify/require"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -77,6 +80,107 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/spec/containers/-",
 				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				},
+			},
+		},
+
+		{
+			"empty pod with RequireAnnotation true and no annotation",
+			Handler{RequireAnnotation: true},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			nil,
+		},
+
+		{
+			"denied namespace",
+			Handler{DeniedNamespaces: []string{"payments"}},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "payments",
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			nil,
+		},
+
+		{
+			"allowed-list bypass",
+			Handler{AllowedNamespaces: []string{"web"}},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "other",
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			nil,
+		},
+
+		{
+			"selector-based exclusion",
+			Handler{NamespaceSelector: labels.SelectorFromSet(labels.Set{"inject": "enabled"})},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: map[string]string{"inject": "disabled"},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			nil,
+		},
+
+		{
+			"selector-based inclusion",
+			Handler{NamespaceSelector: labels.SelectorFromSet(labels.Set{"inject": "enabled"})},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: map[string]string{"inject": "enabled"},
+					},
+
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
@@ -122,6 +226,14 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/spec/containers/-",
 				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
@@ -354,6 +466,35 @@ func TestHandlerContainerSidecar(t *testing.T) {
 			"-upstream=db:1234",
 			"",
 		},
+
+		{
+			"Upstream with named port",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Spec.Containers[0].Ports = []corev1.ContainerPort{
+					{Name: "http", ContainerPort: 8080},
+				}
+				pod.Annotations[annotationUpstreams] = "web:http"
+				return pod
+			},
+			"-upstream=web:8080",
+			"",
+		},
+
+		{
+			"Auto-defaulted named service port",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations = map[string]string{}
+				pod.Spec.Containers[0].Ports = []corev1.ContainerPort{
+					{Name: "http", ContainerPort: 8080},
+				}
+				var h Handler
+				_ = h.defaultAnnotations(pod)
+				return pod
+			},
+			"-service-addr=127.0.0.1:8080",
+			"",
+		},
 	}
 
 	for _, tt := range cases {
@@ -371,9 +512,478 @@ func TestHandlerContainerSidecar(t *testing.T) {
 	}
 }
 
+// TestStrategicJSONPatch verifies two things about the JSON Patch ops
+// strategicJSONPatch returns: that they're valid RFC 6902 ops applying
+// cleanly on their own (no dependency on strategic-merge semantics at
+// apply time, since a real apiserver only understands JSON Patch), and
+// that a container removed by the mutator is actually removed once
+// applied, which a naive JSON Merge Patch diff would miss since removing
+// a list element doesn't produce a representable "remove" by key.
+func TestStrategicJSONPatch(t *testing.T) {
+	require := require.New(t)
+
+	original := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "web"},
+				{Name: "web-side"},
+			},
+		},
+	}
+
+	updated := original.DeepCopy()
+	updated.Spec.Containers = []corev1.Container{{Name: "web"}}
+
+	patch, err := strategicJSONPatch(original, updated)
+	require.NoError(err)
+
+	originalJSON, err := json.Marshal(original)
+	require.NoError(err)
+
+	resultJSON := applyJSONPatch(t, originalJSON, patch)
+
+	var result corev1.Pod
+	require.NoError(json.Unmarshal(resultJSON, &result))
+	require.Equal(updated.Spec.Containers, result.Spec.Containers)
+}
+
+func TestHandlerHandle_strategicMergePatchType(t *testing.T) {
+	require := require.New(t)
+
+	h := Handler{PatchType: StrategicMergePatch}
+	req := v1beta1.AdmissionRequest{
+		Object: encodeRaw(t, &corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "web"}},
+			},
+		}),
+	}
+
+	resp := h.Mutate(&req)
+	require.True(resp.Allowed)
+	require.NotNil(resp.PatchType)
+	require.EqualValues(v1beta1.PatchTypeJSONPatch, *resp.PatchType)
+	require.NotEmpty(resp.Patch)
+
+	var ops []jsonpatch.JsonPatchOperation
+	require.NoError(json.Unmarshal(resp.Patch, &ops))
+	require.NotEmpty(ops)
+}
+
+// fakeCertProvider is a CertProvider that returns canned cert material
+// without talking to a real Consul agent, for testing Handler's TLS
+// bootstrap wiring.
+type fakeCertProvider struct{}
+
+func (f *fakeCertProvider) IssueForPod(pod *corev1.Pod) ([]byte, []byte, []byte, time.Duration, error) {
+	return []byte("cert"), []byte("key"), []byte("ca"), time.Hour, nil
+}
+
+func (f *fakeCertProvider) RenewerContainer() corev1.Container {
+	return corev1.Container{Name: "consul-connect-cert-renewer"}
+}
+
+// rawPatchOp mirrors jsonpatch.JsonPatchOperation but keeps Value as raw
+// JSON so tests can unmarshal it into the concrete type they expect.
+type rawPatchOp struct {
+	Operation string          `json:"op"`
+	Path      string          `json:"path"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// patchContainers collects every corev1.Container added at base (whether
+// as a whole-array "add" or an individual "/-" append) across patches.
+func patchContainers(t *testing.T, patches []rawPatchOp, base string) []corev1.Container {
+	var containers []corev1.Container
+	for _, p := range patches {
+		switch p.Path {
+		case base:
+			var cs []corev1.Container
+			require.NoError(t, json.Unmarshal(p.Value, &cs))
+			containers = append(containers, cs...)
+		case base + "/-":
+			var c corev1.Container
+			require.NoError(t, json.Unmarshal(p.Value, &c))
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// patchVolumes is patchContainers' counterpart for corev1.Volume.
+func patchVolumes(t *testing.T, patches []rawPatchOp, base string) []corev1.Volume {
+	var volumes []corev1.Volume
+	for _, p := range patches {
+		switch p.Path {
+		case base:
+			var vs []corev1.Volume
+			require.NoError(t, json.Unmarshal(p.Value, &vs))
+			volumes = append(volumes, vs...)
+		case base + "/-":
+			var v corev1.Volume
+			require.NoError(t, json.Unmarshal(p.Value, &v))
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes
+}
+
+func TestHandlerHandle_certProvider(t *testing.T) {
+	require := require.New(t)
+
+	h := Handler{
+		ImageConsul:  "consul:latest",
+		CertProvider: &fakeCertProvider{},
+	}
+	req := v1beta1.AdmissionRequest{
+		Object: encodeRaw(t, &corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "web"}},
+			},
+		}),
+	}
+
+	resp := h.Mutate(&req)
+	require.True(resp.Allowed)
+
+	var patches []rawPatchOp
+	require.NoError(json.Unmarshal(resp.Patch, &patches))
+
+	volumes := patchVolumes(t, patches, "/spec/volumes")
+	var volumeNames []string
+	for _, v := range volumes {
+		volumeNames = append(volumeNames, v.Name)
+	}
+	require.Contains(volumeNames, certVolumeName)
+
+	initContainers := patchContainers(t, patches, "/spec/initContainers")
+	var sawCertInit bool
+	for _, c := range initContainers {
+		if c.Name == "consul-connect-cert-init" {
+			sawCertInit = true
+		}
+	}
+	require.True(sawCertInit, "expected a cert-writing init container")
+
+	containers := patchContainers(t, patches, "/spec/containers")
+	var sawRenewer bool
+	for _, c := range containers {
+		if c.Name == "consul-connect-cert-renewer" {
+			sawRenewer = true
+			require.Contains(c.Env, corev1.EnvVar{Name: "CONNECT_SERVICE_NAME", Value: "web"})
+		}
+		if c.Name == "consul-connect-envoy-sidecar" {
+			require.Contains(c.VolumeMounts, corev1.VolumeMount{Name: certVolumeName, MountPath: "/consul/connect-inject/certs"})
+			require.Contains(c.Command, "-tls-cert-file=/consul/connect-inject/certs/cert.pem")
+		}
+	}
+	require.True(sawRenewer, "expected the cert renewer sidecar")
+}
+
+func TestHandlerContainerInit(t *testing.T) {
+	minimal := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "web-abc123",
+				Annotations: map[string]string{
+					annotationService: "web",
+				},
+			},
+
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					corev1.Container{
+						Name: "web",
+						Ports: []corev1.ContainerPort{
+							corev1.ContainerPort{
+								Name:          "http",
+								ContainerPort: 8080,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		Name string
+		Pod  func(*corev1.Pod) *corev1.Pod
+		Cmd  string // Strings.Contains test
+		Err  string
+	}{
+		{
+			"Basic service",
+			func(pod *corev1.Pod) *corev1.Pod {
+				return pod
+			},
+			`name = "web"`,
+			"",
+		},
+
+		{
+			"With port",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationPort] = "1234"
+				return pod
+			},
+			"port = 1234",
+			"",
+		},
+
+		{
+			"With numeric upstream",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationUpstreams] = "db:1234"
+				return pod
+			},
+			`destination_name = "db"`,
+			"",
+		},
+
+		{
+			"With named-port upstream",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationUpstreams] = "web:http"
+				return pod
+			},
+			"local_bind_port = 8080",
+			"",
+		},
+
+		{
+			"Invalid upstream",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationUpstreams] = "db"
+				return pod
+			},
+			"",
+			"not in the form name:port",
+		},
+
+		{
+			"Auto-defaulted named service port",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations = map[string]string{}
+				var h Handler
+				_ = h.defaultAnnotations(pod)
+				return pod
+			},
+			"port = 8080",
+			"",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			var h Handler
+			container, err := h.containerInit(tt.Pod(minimal()))
+			if tt.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tt.Err)
+				return
+			}
+
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Cmd)
+		})
+	}
+}
+
+func TestHandlerContainerEnvVars(t *testing.T) {
+	minimal := func() *corev1.Pod {
+		return &corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					corev1.Container{
+						Name: "web",
+						Ports: []corev1.ContainerPort{
+							corev1.ContainerPort{
+								Name:          "http",
+								ContainerPort: 8080,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		Name      string
+		Upstreams string
+		Expected  []corev1.EnvVar
+		Err       string
+	}{
+		{
+			"No upstreams",
+			"",
+			nil,
+			"",
+		},
+
+		{
+			"Upstream parsing",
+			"db:1234",
+			[]corev1.EnvVar{
+				{Name: "DB_CONNECT_SERVICE_HOST", Value: "127.0.0.1"},
+				{Name: "DB_CONNECT_SERVICE_PORT", Value: "1234"},
+			},
+			"",
+		},
+
+		{
+			"Port-name resolution",
+			"web:http",
+			[]corev1.EnvVar{
+				{Name: "WEB_CONNECT_SERVICE_HOST", Value: "127.0.0.1"},
+				{Name: "WEB_CONNECT_SERVICE_PORT", Value: "8080"},
+			},
+			"",
+		},
+
+		{
+			"Hyphen-to-underscore normalization",
+			"billing-db:1234",
+			[]corev1.EnvVar{
+				{Name: "BILLING_DB_CONNECT_SERVICE_HOST", Value: "127.0.0.1"},
+				{Name: "BILLING_DB_CONNECT_SERVICE_PORT", Value: "1234"},
+			},
+			"",
+		},
+
+		{
+			"Invalid upstream",
+			"db",
+			nil,
+			"not in the form name:port",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			pod := minimal()
+			if tt.Upstreams != "" {
+				pod.Annotations = map[string]string{annotationUpstreams: tt.Upstreams}
+			}
+
+			var h Handler
+			envVars, err := h.containerEnvVars(pod)
+			if tt.Err != "" {
+				require.Error(err)
+				require.Contains(err.Error(), tt.Err)
+				return
+			}
+
+			require.NoError(err)
+			require.Equal(tt.Expected, envVars)
+		})
+	}
+}
+
 // encodeRaw is a helper to encode some data into a RawExtension.
 func encodeRaw(t *testing.T, input interface{}) runtime.RawExtension {
 	data, err := json.Marshal(input)
 	require.NoError(t, err)
 	return runtime.RawExtension{Raw: data}
 }
+
+// applyJSONPatch applies an RFC 6902 JSON Patch ops array to docJSON and
+// returns the result, as a minimal stand-in for the apiserver's own patch
+// application so tests can assert on the patch's actual effect rather
+// than trusting that it round-trips.
+func applyJSONPatch(t *testing.T, docJSON, opsJSON []byte) []byte {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal(docJSON, &doc))
+
+	var ops []jsonpatch.JsonPatchOperation
+	require.NoError(t, json.Unmarshal(opsJSON, &ops))
+
+	for _, op := range ops {
+		tokens := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		for i, tok := range tokens {
+			tok = strings.Replace(tok, "~1", "/", -1)
+			tokens[i] = strings.Replace(tok, "~0", "~", -1)
+		}
+
+		valueJSON, err := json.Marshal(op.Value)
+		require.NoError(t, err)
+
+		doc = applyJSONPatchAt(t, doc, tokens, op.Operation, valueJSON)
+	}
+
+	out, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return out
+}
+
+// applyJSONPatchAt applies a single JSON Patch operation's "add"/
+// "remove"/"replace" semantics to doc at the JSON Pointer named by
+// tokens, returning the (possibly new, for slices) updated doc.
+func applyJSONPatchAt(t *testing.T, doc interface{}, tokens []string, op string, valueJSON []byte) interface{} {
+	if len(tokens) > 1 {
+		key := tokens[0]
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			d[key] = applyJSONPatchAt(t, d[key], tokens[1:], op, valueJSON)
+			return d
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			require.NoError(t, err)
+			d[i] = applyJSONPatchAt(t, d[i], tokens[1:], op, valueJSON)
+			return d
+		}
+		t.Fatalf("cannot index into %T with %q", doc, key)
+	}
+
+	key := tokens[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if op == "remove" {
+			delete(d, key)
+			return d
+		}
+
+		var v interface{}
+		require.NoError(t, json.Unmarshal(valueJSON, &v))
+		d[key] = v
+		return d
+
+	case []interface{}:
+		switch op {
+		case "remove":
+			i, err := strconv.Atoi(key)
+			require.NoError(t, err)
+			return append(d[:i], d[i+1:]...)
+
+		case "replace":
+			i, err := strconv.Atoi(key)
+			require.NoError(t, err)
+			var v interface{}
+			require.NoError(t, json.Unmarshal(valueJSON, &v))
+			d[i] = v
+			return d
+
+		default: // "add"
+			var v interface{}
+			require.NoError(t, json.Unmarshal(valueJSON, &v))
+			if key == "-" {
+				return append(d, v)
+			}
+			i, err := strconv.Atoi(key)
+			require.NoError(t, err)
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = v
+			return d
+		}
+	}
+
+	t.Fatalf("cannot apply %q to %T", op, doc)
+	return doc
+}
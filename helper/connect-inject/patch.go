@@ -0,0 +1,119 @@
+package connectinject
+
+import (
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// escapeJSONPointer escapes a reference token for embedding in a JSON
+// Pointer path, as defined by RFC 6901. Our annotation keys always
+// contain "/" (the domain/name separator), so this is needed any time we
+// build a path that addresses a single annotation by key.
+func escapeJSONPointer(s string) string {
+	s = strings.Replace(s, "~", "~0", -1)
+	s = strings.Replace(s, "/", "~1", -1)
+	return s
+}
+
+// addContainer returns the patch operations needed to append add to the
+// container slice found at base (e.g. "/spec/containers" or
+// "/spec/initContainers"). If existing is empty the first container is
+// added as a one-element slice, since the field may not exist on the
+// original object; every other container is appended individually so we
+// don't clobber containers other webhooks may have added.
+func addContainer(existing, add []corev1.Container, base string) []jsonpatch.JsonPatchOperation {
+	var result []jsonpatch.JsonPatchOperation
+
+	path := base
+	var value interface{}
+	for _, c := range add {
+		value = c
+		if len(existing) == 0 {
+			value = []corev1.Container{c}
+		} else {
+			path = base + "/-"
+		}
+
+		result = append(result, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path,
+			Value:     value,
+		})
+
+		existing = append(existing, c)
+	}
+
+	return result
+}
+
+// addVolume returns the patch operations needed to append add to the
+// volume slice found at base, following the same empty-vs-append
+// semantics as addContainer.
+func addVolume(existing, add []corev1.Volume, base string) []jsonpatch.JsonPatchOperation {
+	var result []jsonpatch.JsonPatchOperation
+
+	path := base
+	var value interface{}
+	for _, v := range add {
+		value = v
+		if len(existing) == 0 {
+			value = []corev1.Volume{v}
+		} else {
+			path = base + "/-"
+		}
+
+		result = append(result, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path,
+			Value:     value,
+		})
+
+		existing = append(existing, v)
+	}
+
+	return result
+}
+
+// addEnvVar returns the patch operations needed to append vars to the Env
+// slice of a single container found at path (e.g.
+// "/spec/containers/0/env"), following the same empty-vs-append
+// semantics as addContainer.
+func addEnvVar(existing, vars []corev1.EnvVar, path string) []jsonpatch.JsonPatchOperation {
+	var result []jsonpatch.JsonPatchOperation
+
+	for _, v := range vars {
+		op := jsonpatch.JsonPatchOperation{Operation: "add", Path: path, Value: []corev1.EnvVar{v}}
+		if len(existing) > 0 {
+			op = jsonpatch.JsonPatchOperation{Operation: "add", Path: path + "/-", Value: v}
+		}
+
+		result = append(result, op)
+		existing = append(existing, v)
+	}
+
+	return result
+}
+
+// updateAnnotation returns the patch operations needed to set each key in
+// updates on the pod's annotations, using "replace" for keys that are
+// already present and "add" otherwise.
+func updateAnnotation(existing, updates map[string]string) []jsonpatch.JsonPatchOperation {
+	var result []jsonpatch.JsonPatchOperation
+
+	for k, v := range updates {
+		op := "add"
+		if _, ok := existing[k]; ok {
+			op = "replace"
+		}
+
+		result = append(result, jsonpatch.JsonPatchOperation{
+			Operation: op,
+			Path:      "/metadata/annotations/" + escapeJSONPointer(k),
+			Value:     v,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+package connectinject
+
+import (
+	"encoding/json"
+
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// strategicJSONPatch computes the changes needed to turn original into
+// updated by diffing them as a strategic merge patch against the
+// corev1.Pod schema, then translates that into an RFC 6902 JSON Patch ops
+// array. The strategic merge diff is what gives this mode its advantage
+// over the hand-rolled ops in jsonPatchResponse: it correctly represents
+// fields the mutator removed, and merges list fields by key instead of by
+// index. The translation back to JSON Patch is required because
+// AdmissionResponse.PatchType has exactly one legal value the apiserver
+// accepts, "JSONPatch" - returning a strategic merge patch body directly,
+// even with an accurate PatchType string, is rejected by a real
+// apiserver.
+func strategicJSONPatch(original, updated *corev1.Pod) ([]byte, error) {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedJSON, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	mergePatch, err := strategicpatch.CreateTwoWayMergePatch(originalJSON, updatedJSON, corev1.Pod{})
+	if err != nil {
+		return nil, err
+	}
+
+	mergedJSON, err := strategicpatch.StrategicMergePatch(originalJSON, mergePatch, corev1.Pod{})
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := jsonpatch.CreatePatch(originalJSON, mergedJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ops)
+}